@@ -0,0 +1,274 @@
+package sftp
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// NewClient creates a TFTP client that talks to the server at addr. The
+// returned Client is used to initiate outgoing transfers with Send and
+// Receive; it does not listen for incoming requests.
+func NewClient(addr string) (*Client, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		raddr:   raddr,
+		timeout: defaultTimeout,
+		retries: defaultRetries,
+	}, nil
+}
+
+// Client is the counterpart to Server: where Server answers RRQ/WRQ
+// packets sent to it, Client originates them. It reuses the same
+// sender/receiver state machines, packet parsers, option negotiation and
+// backoff that Server does.
+type Client struct {
+	raddr      *net.UDPAddr
+	backoff    backoffFunc
+	timeout    time.Duration
+	retries    int
+	blksize    int
+	windowSize uint16
+}
+
+// SetTimeout sets maximum time the client waits for a single network
+// round-trip to succeed.
+// Default is 5 seconds.
+func (c *Client) SetTimeout(t time.Duration) {
+	if t <= 0 {
+		c.timeout = defaultTimeout
+	} else {
+		c.timeout = t
+	}
+}
+
+// SetRetries sets maximum number of attempts the client makes to
+// transmit a packet.
+// Default is 5 attempts.
+func (c *Client) SetRetries(count int) {
+	if count < 1 {
+		c.retries = defaultRetries
+	} else {
+		c.retries = count
+	}
+}
+
+// SetBackoff sets a user provided function that is called to provide a
+// backoff duration prior to retransmitting an unacknowledged packet.
+func (c *Client) SetBackoff(h backoffFunc) {
+	c.backoff = h
+}
+
+// SetBlockSize requests blksize as the DATA block size to negotiate with
+// the server. Valid range is defaultBlockSize..maxBlockSize; an invalid
+// value disables the request and the classic 512-byte default is used.
+func (c *Client) SetBlockSize(blksize int) {
+	if blksize < defaultBlockSize || blksize > maxBlockSize {
+		c.blksize = 0
+	} else {
+		c.blksize = blksize
+	}
+}
+
+// SetWindowSize requests the RFC 7440 window size to negotiate with the
+// server: the number of DATA blocks a transfer may send before an ACK is
+// required. Valid range is 1..65535; an invalid value falls back to the
+// classic windowsize=1 lock-step behavior.
+func (c *Client) SetWindowSize(n int) {
+	if n < 1 || n > 65535 {
+		c.windowSize = 0
+	} else {
+		c.windowSize = uint16(n)
+	}
+}
+
+func (c *Client) options() options {
+	opts := options{}
+	if c.blksize != 0 {
+		opts["blksize"] = strconv.Itoa(c.blksize)
+	}
+	if c.windowSize != 0 {
+		opts["windowsize"] = strconv.Itoa(int(c.windowSize))
+	}
+	if len(opts) == 0 {
+		return nil
+	}
+	return opts
+}
+
+// Send initiates an outgoing write: it transmits a WRQ for filename and
+// returns an io.ReaderFrom bound to the server's replied TID. The
+// returned value is a *sender, the same type Server uses to answer RRQ
+// requests, so calling ReadFrom on it pushes DATA blocks and waits for
+// ACKs exactly as the server does when serving a read.
+func (c *Client) Send(filename, mode string) (io.ReaderFrom, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	s := &sender{
+		send:      make([]byte, datagramLength),
+		receive:   make([]byte, datagramLength),
+		conn:      conn,
+		ownsConn:  true,
+		retry:     &backoff{handler: c.backoff},
+		timeout:   c.timeout,
+		retries:   c.retries,
+		mode:      mode,
+		maxWindow: c.windowSize,
+	}
+	req := make([]byte, datagramLength)
+	n := packRQ(req, opWRQ, filename, mode, c.options())
+	p, _, addr, err := c.requestWithRetry(s.conn, s.retry, req[:n], s.receive)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s.addr = addr
+	s.tid = addr.Port
+	switch p := p.(type) {
+	case pACK:
+		if p.block() != 0 {
+			conn.Close()
+			return nil, fmt.Errorf("unexpected ack for block %d", p.block())
+		}
+	case pOACK:
+		oack, err := unpackOACK(p)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if v, ok := oack["blksize"]; ok {
+			if err := s.setBlockSize(v); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		if v, ok := oack["windowsize"]; ok {
+			if err := s.setWindowSize(v); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+	case pERROR:
+		conn.Close()
+		return nil, fmt.Errorf("code: %d, message: %s", p.code(), p.message())
+	default:
+		conn.Close()
+		return nil, fmt.Errorf("unexpected %T in reply to WRQ", p)
+	}
+	return s, nil
+}
+
+// Receive initiates an outgoing read: it transmits a RRQ for filename
+// and returns an io.WriterTo bound to the server's replied TID. The
+// returned value is a *receiver, the same type Server uses to answer
+// WRQ requests, so calling WriteTo on it receives DATA blocks and sends
+// ACKs exactly as the server does when accepting a write.
+func (c *Client) Receive(filename, mode string) (io.WriterTo, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	r := &receiver{
+		send:      make([]byte, datagramLength),
+		receive:   make([]byte, datagramLength),
+		conn:      conn,
+		ownsConn:  true,
+		retry:     &backoff{handler: c.backoff},
+		timeout:   c.timeout,
+		retries:   c.retries,
+		mode:      mode,
+		maxWindow: c.windowSize,
+		autoTerm:  true,
+	}
+	req := make([]byte, datagramLength)
+	n := packRQ(req, opRRQ, filename, mode, c.options())
+	p, rn, addr, err := c.requestWithRetry(r.conn, r.retry, req[:n], r.receive)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r.addr = addr
+	r.tid = addr.Port
+	switch p := p.(type) {
+	case pDATA:
+		if p.block() != 1 {
+			conn.Close()
+			return nil, fmt.Errorf("unexpected data for block %d", p.block())
+		}
+		r.block = 1
+		r.l = rn
+	case pOACK:
+		oack, err := unpackOACK(p)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if v, ok := oack["blksize"]; ok {
+			if err := r.setBlockSize(v); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		if v, ok := oack["windowsize"]; ok {
+			if err := r.setWindowSize(v); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		r.block = 0 // ACK with block number 0, as receiver's own pOACK handling does
+	case pERROR:
+		conn.Close()
+		return nil, fmt.Errorf("code: %d, message: %s", p.code(), p.message())
+	default:
+		conn.Close()
+		return nil, fmt.Errorf("unexpected %T in reply to RRQ", p)
+	}
+	return r, nil
+}
+
+// requestWithRetry sends req to c.raddr, retrying on timeout per the
+// backoff policy, and returns the first reply packet, its raw length,
+// and the address it came from. That address becomes the locked TID for
+// the rest of the transfer, the same tid-locking receiveDatagram already
+// does once a transfer is under way.
+func (c *Client) requestWithRetry(conn *net.UDPConn, retry *backoff, req, buf []byte) (interface{}, int, *net.UDPAddr, error) {
+	retry.reset()
+	for {
+		p, n, addr, err := c.request(conn, req, buf)
+		if _, ok := err.(net.Error); ok && retry.count() < c.retries {
+			retry.backoff()
+			continue
+		}
+		return p, n, addr, err
+	}
+}
+
+func (c *Client) request(conn *net.UDPConn, req, buf []byte) (interface{}, int, *net.UDPAddr, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return nil, 0, nil, err
+	}
+	if _, err := conn.WriteToUDP(req, c.raddr); err != nil {
+		return nil, 0, nil, err
+	}
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		if !addr.IP.Equal(c.raddr.IP) {
+			continue
+		}
+		p, err := parsePacket(buf[:n])
+		if err != nil {
+			return nil, 0, addr, err
+		}
+		return p, n, addr, nil
+	}
+}
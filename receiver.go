@@ -1,205 +1,356 @@
-package sftp
-
-import (
-	"encoding/binary"
-	"fmt"
-	"io"
-	"net"
-	"strconv"
-	"time"
-)
-
-type receiver struct {
-	send     []byte
-	receive  []byte
-	addr     *net.UDPAddr
-	conn     *net.UDPConn
-	localIP  net.IP
-	tid      int
-	block    uint16
-	retry    *backoff
-	timeout  time.Duration
-	retries  int
-	l        int
-	dally    bool
-	autoTerm bool
-	mode     string
-	opts     options
-}
-
-func (r *receiver) WriteTo(w io.Writer) (n int64, err error) {
-	if r.opts != nil {
-		err := r.sendOptions()
-		if err != nil {
-			r.abort(err)
-			return 0, err
-		}
-	}
-	binary.BigEndian.PutUint16(r.send[:2], opACK)
-	for {
-		if r.l > 0 {
-			l, err := w.Write(r.receive[4:r.l])
-			n += int64(l)
-			if err != nil {
-				r.abort(err)
-				return n, err
-			}
-			if r.l < len(r.receive) {
-				if r.autoTerm {
-					r.terminate()
-				}
-				return n, nil
-			}
-		}
-		binary.BigEndian.PutUint16(r.send[2:4], r.block)
-		r.block++ // send ACK for current block and expect next one
-		ll, _, err := r.receiveWithRetry(4)
-		if err != nil {
-			r.abort(err)
-			return n, err
-		}
-		r.l = ll
-	}
-}
-
-func (r *receiver) sendOptions() error {
-	for name, value := range r.opts {
-		if name == "blksize" {
-			err := r.setBlockSize(value)
-			if err != nil {
-				delete(r.opts, name)
-				continue
-			}
-		} else {
-			delete(r.opts, name)
-		}
-	}
-	if len(r.opts) > 0 {
-		m := packOACK(r.send, r.opts)
-		r.block = 1 // expect data block number 1
-		ll, _, err := r.receiveWithRetry(m)
-		if err != nil {
-			r.abort(err)
-			return err
-		}
-		r.l = ll
-	}
-	return nil
-}
-
-func (r *receiver) setBlockSize(blksize string) error {
-	n, err := strconv.Atoi(blksize)
-	if err != nil {
-		return err
-	}
-	if n < defaultBlockSize {
-		return fmt.Errorf("blksize too small: %d", n)
-	}
-	if n > maxBlockSize {
-		return fmt.Errorf("blksize tool large: %d", n)
-	}
-	r.receive = make([]byte, n+4)
-	return nil
-}
-
-func (r *receiver) receiveWithRetry(l int) (int, *net.UDPAddr, error) {
-	r.retry.reset()
-	for {
-		n, addr, err := r.receiveDatagram(l)
-		if _, ok := err.(net.Error); ok && r.retry.count() < r.retries {
-			r.retry.backoff()
-			continue
-		}
-		return n, addr, err
-	}
-}
-
-func (r *receiver) receiveDatagram(l int) (int, *net.UDPAddr, error) {
-	err := r.conn.SetReadDeadline(time.Now().Add(r.timeout))
-	if err != nil {
-		return 0, nil, err
-	}
-	_, err = r.conn.WriteToUDP(r.send[:l], r.addr)
-	if err != nil {
-		return 0, nil, err
-	}
-	for {
-		c, addr, err := r.conn.ReadFromUDP(r.receive)
-		if err != nil {
-			return 0, nil, err
-		}
-		if !addr.IP.Equal(r.addr.IP) || (r.tid != 0 && addr.Port != r.tid) {
-			continue
-		}
-		p, err := parsePacket(r.receive[:c])
-		if err != nil {
-			return 0, addr, err
-		}
-		r.tid = addr.Port
-		switch p := p.(type) {
-		case pDATA:
-			if p.block() == r.block {
-				return c, addr, nil
-			}
-		case pOACK:
-			opts, err := unpackOACK(p)
-			if r.block != 1 {
-				continue
-			}
-			if err != nil {
-				r.abort(err)
-				return 0, addr, err
-			}
-			for name, value := range opts {
-				if name == "blksize" {
-					err := r.setBlockSize(value)
-					if err != nil {
-						continue
-					}
-				}
-			}
-			r.block = 0 // ACK with block number 0
-			r.opts = opts
-			return 0, addr, nil
-		case pERROR:
-			return 0, addr, fmt.Errorf("code: %d, message: %s",
-				p.code(), p.message())
-		}
-	}
-}
-
-func (r *receiver) terminate() error {
-	if r.conn == nil {
-		return nil
-	}
-	defer r.conn.Close()
-	binary.BigEndian.PutUint16(r.send[2:4], r.block)
-	if r.dally {
-		for i := 0; i < 3; i++ {
-			_, _, err := r.receiveDatagram(4)
-			if err != nil {
-				return nil
-			}
-		}
-		return fmt.Errorf("dallying termination failed")
-	} else {
-		_, err := r.conn.WriteToUDP(r.send[:4], r.addr)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-func (r *receiver) abort(err error) error {
-	if r.conn == nil {
-		return nil
-	}
-	defer func() {
-		r.conn.Close()
-		r.conn = nil
-	}()
-	n := packERROR(r.send, 1, err.Error())
-	_, err = r.conn.WriteToUDP(r.send[:n], r.addr)
-	return err
-}
+package sftp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+type receiver struct {
+	send       []byte
+	receive    []byte
+	addr       *net.UDPAddr
+	conn       *net.UDPConn
+	ownsConn   bool
+	in         <-chan incomingPacket
+	localIP    net.IP
+	tid        int
+	block      uint16
+	windowSize uint16
+	maxWindow  uint16
+	retry      *backoff
+	timeout    time.Duration
+	retries    int
+	l          int
+	dally      bool
+	autoTerm   bool
+	mode       string
+	opts       options
+	size       int64
+	sizeKnown  bool
+}
+
+// WindowSize returns the window size negotiated with the peer, i.e. the
+// number of DATA blocks the peer may send before an ACK is required. It
+// is 1 unless RFC 7440 windowsize negotiation succeeded.
+func (r *receiver) WindowSize() int {
+	if r.windowSize == 0 {
+		return 1
+	}
+	return int(r.windowSize)
+}
+
+// Size returns the transfer size the client declared via the RFC 2349
+// tsize option, and whether tsize was negotiated at all. A write handler
+// can use this to reject an over-quota transfer before receiving any
+// data.
+func (r *receiver) Size() (int64, bool) {
+	return r.size, r.sizeKnown
+}
+
+func (r *receiver) WriteTo(w io.Writer) (n int64, err error) {
+	if r.opts != nil {
+		err := r.sendOptions()
+		if err != nil {
+			r.abort(err)
+			return 0, err
+		}
+	}
+	if r.windowSize == 0 {
+		r.windowSize = 1
+	}
+	binary.BigEndian.PutUint16(r.send[:2], opACK)
+	// sendAck tracks whether the next ACK we compose should actually be
+	// put on the wire: the initial handshake ACK, and then once every
+	// windowSize DATA blocks received, per RFC 7440 §3.
+	sendAck := true
+	var received uint16
+	if r.l > 0 {
+		// The first DATA block is already buffered: sendOptions received
+		// it after the OACK, or Client.Receive got it as the RRQ's reply.
+		received++
+		sendAck = received >= r.windowSize
+	}
+	for {
+		if r.l > 0 {
+			l, err := w.Write(r.receive[4:r.l])
+			n += int64(l)
+			if err != nil {
+				r.abort(err)
+				return n, err
+			}
+			if r.l < len(r.receive) {
+				if r.autoTerm {
+					r.terminate()
+				}
+				return n, nil
+			}
+		}
+		r.block++ // expect the next block
+		binary.BigEndian.PutUint16(r.send[2:4], r.block-1)
+		ll, _, err := r.receiveWithRetry(4, sendAck)
+		if err != nil {
+			r.abort(err)
+			return n, err
+		}
+		r.l = ll
+		if sendAck {
+			received = 0
+		}
+		received++
+		sendAck = received >= r.windowSize
+	}
+}
+
+func (r *receiver) sendOptions() error {
+	for name, value := range r.opts {
+		switch name {
+		case "blksize":
+			err := r.setBlockSize(value)
+			if err != nil {
+				delete(r.opts, name)
+				continue
+			}
+		case "windowsize":
+			err := r.setWindowSize(value)
+			if err != nil {
+				delete(r.opts, name)
+				continue
+			}
+		case "tsize":
+			// Already parsed in handlePacket so the write handler could see
+			// it before any data arrived; nothing left to do but echo it
+			// back to confirm acceptance.
+			if !r.sizeKnown {
+				delete(r.opts, name)
+				continue
+			}
+		case "timeout":
+			err := r.setTimeout(value)
+			if err != nil {
+				delete(r.opts, name)
+				continue
+			}
+		default:
+			delete(r.opts, name)
+		}
+	}
+	if len(r.opts) > 0 {
+		m := packOACK(r.send, r.opts)
+		r.block = 1 // expect data block number 1
+		ll, _, err := r.receiveWithRetry(m, true)
+		if err != nil {
+			r.abort(err)
+			return err
+		}
+		r.l = ll
+	}
+	return nil
+}
+
+func (r *receiver) setBlockSize(blksize string) error {
+	n, err := strconv.Atoi(blksize)
+	if err != nil {
+		return err
+	}
+	if n < defaultBlockSize {
+		return fmt.Errorf("blksize too small: %d", n)
+	}
+	if n > maxBlockSize {
+		return fmt.Errorf("blksize tool large: %d", n)
+	}
+	r.receive = make([]byte, n+4)
+	return nil
+}
+
+func (r *receiver) setWindowSize(windowsize string) error {
+	n, err := strconv.Atoi(windowsize)
+	if err != nil {
+		return err
+	}
+	if n < 1 || n > 65535 {
+		return fmt.Errorf("windowsize out of range: %d", n)
+	}
+	// maxWindow == 0 means the operator never opted into windowing at
+	// all, so the negotiated size must not exceed the classic default.
+	max := int(r.maxWindow)
+	if max == 0 {
+		max = 1
+	}
+	if n > max {
+		return fmt.Errorf("windowsize too large: %d", n)
+	}
+	r.windowSize = uint16(n)
+	return nil
+}
+
+func (r *receiver) setTsize(tsize string) error {
+	n, err := strconv.ParseInt(tsize, 10, 64)
+	if err != nil {
+		return err
+	}
+	if n < 0 {
+		return fmt.Errorf("tsize out of range: %d", n)
+	}
+	r.size = n
+	r.sizeKnown = true
+	return nil
+}
+
+func (r *receiver) setTimeout(timeout string) error {
+	n, err := strconv.Atoi(timeout)
+	if err != nil {
+		return err
+	}
+	if n < 1 || n > 255 {
+		return fmt.Errorf("timeout out of range: %d", n)
+	}
+	r.timeout = time.Duration(n) * time.Second
+	return nil
+}
+
+// readFromUDP reads the next datagram addressed to this transfer. In
+// classic mode it reads r.conn directly; in single-port mode r.conn is
+// shared across transfers, so it instead waits on the per-transfer
+// channel that Server.handlePacket demultiplexes incoming datagrams
+// into, timing out the same way a real socket read would.
+func (r *receiver) readFromUDP() (int, *net.UDPAddr, error) {
+	if r.in == nil {
+		return r.conn.ReadFromUDP(r.receive)
+	}
+	select {
+	case pkt, ok := <-r.in:
+		if !ok {
+			return 0, nil, fmt.Errorf("transfer channel closed")
+		}
+		return copy(r.receive, pkt.buf), pkt.addr, nil
+	case <-time.After(r.timeout):
+		return 0, nil, chanReadTimeout{}
+	}
+}
+
+func (r *receiver) receiveWithRetry(l int, sendAck bool) (int, *net.UDPAddr, error) {
+	r.retry.reset()
+	for {
+		n, addr, err := r.receiveDatagram(l, sendAck)
+		if _, ok := err.(net.Error); ok && r.retry.count() < r.retries {
+			r.retry.backoff()
+			continue
+		}
+		return n, addr, err
+	}
+}
+
+// receiveDatagram waits for the next expected DATA block, optionally
+// ACKing beforehand. When sendAck is false, it only listens: this is
+// used mid-window, where RFC 7440 does not require (or want) an ACK for
+// every block.
+func (r *receiver) receiveDatagram(l int, sendAck bool) (int, *net.UDPAddr, error) {
+	if r.in == nil {
+		if err := r.conn.SetReadDeadline(time.Now().Add(r.timeout)); err != nil {
+			return 0, nil, err
+		}
+	}
+	if sendAck {
+		if _, err := r.conn.WriteToUDP(r.send[:l], r.addr); err != nil {
+			return 0, nil, err
+		}
+	}
+	for {
+		c, addr, err := r.readFromUDP()
+		if err != nil {
+			return 0, nil, err
+		}
+		if !addr.IP.Equal(r.addr.IP) || (r.tid != 0 && addr.Port != r.tid) {
+			continue
+		}
+		p, err := parsePacket(r.receive[:c])
+		if err != nil {
+			return 0, addr, err
+		}
+		r.tid = addr.Port
+		switch p := p.(type) {
+		case pDATA:
+			if p.block() == r.block {
+				return c, addr, nil
+			}
+			// Out-of-order block: the rest of the window was lost or
+			// reordered. ACK the last in-order block we actually have so
+			// the sender rewinds and resends from there.
+			binary.BigEndian.PutUint16(r.send[2:4], r.block-1)
+			if _, err := r.conn.WriteToUDP(r.send[:4], r.addr); err != nil {
+				return 0, addr, err
+			}
+		case pOACK:
+			opts, err := unpackOACK(p)
+			if r.block != 1 {
+				continue
+			}
+			if err != nil {
+				r.abort(err)
+				return 0, addr, err
+			}
+			for name, value := range opts {
+				switch name {
+				case "blksize":
+					if err := r.setBlockSize(value); err != nil {
+						continue
+					}
+				case "windowsize":
+					if err := r.setWindowSize(value); err != nil {
+						continue
+					}
+				}
+			}
+			r.block = 0 // ACK with block number 0
+			r.opts = opts
+			return 0, addr, nil
+		case pERROR:
+			return 0, addr, fmt.Errorf("code: %d, message: %s",
+				p.code(), p.message())
+		}
+	}
+}
+
+func (r *receiver) terminate() error {
+	if r.conn == nil {
+		return nil
+	}
+	if r.ownsConn {
+		defer r.conn.Close()
+	}
+	binary.BigEndian.PutUint16(r.send[2:4], r.block)
+	if r.dally {
+		for i := 0; i < 3; i++ {
+			_, _, err := r.receiveDatagram(4, true)
+			if err != nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("dallying termination failed")
+	} else {
+		_, err := r.conn.WriteToUDP(r.send[:4], r.addr)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *receiver) abort(err error) error {
+	if r.conn == nil {
+		return nil
+	}
+	defer func() {
+		if r.ownsConn {
+			r.conn.Close()
+		}
+		r.conn = nil
+	}()
+	n := packERROR(r.send, 1, err.Error())
+	_, err = r.conn.WriteToUDP(r.send[:n], r.addr)
+	return err
+}
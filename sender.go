@@ -0,0 +1,312 @@
+package sftp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+type sender struct {
+	send       []byte
+	receive    []byte
+	window     [][]byte
+	addr       *net.UDPAddr
+	conn       *net.UDPConn
+	ownsConn   bool
+	in         <-chan incomingPacket
+	localIP    net.IP
+	tid        int
+	block      uint16
+	windowSize uint16
+	maxWindow  uint16
+	retry      *backoff
+	timeout    time.Duration
+	retries    int
+	mode       string
+	opts       options
+	size       int64
+	sizeKnown  bool
+}
+
+// WindowSize returns the window size negotiated with the peer, i.e. the
+// number of DATA blocks we may send before an ACK is required. It is 1
+// unless RFC 7440 windowsize negotiation succeeded.
+func (s *sender) WindowSize() int {
+	if s.windowSize == 0 {
+		return 1
+	}
+	return int(s.windowSize)
+}
+
+// SetSize tells the sender the total size of the file being transferred,
+// in bytes. A read handler should call this before reading from its
+// io.Reader, so that a tsize request in the RRQ can be answered in the
+// OACK. Size reports back whatever was set.
+func (s *sender) SetSize(n int64) {
+	s.size = n
+	s.sizeKnown = true
+}
+
+// Size returns the file size previously set with SetSize, and whether
+// SetSize has been called. The flag does not say whether the peer asked
+// for tsize.
+func (s *sender) Size() (int64, bool) {
+	return s.size, s.sizeKnown
+}
+
+func (s *sender) ReadFrom(r io.Reader) (n int64, err error) {
+	if s.opts != nil {
+		err := s.sendOptions()
+		if err != nil {
+			s.abort(err)
+			return 0, err
+		}
+	}
+	if s.windowSize == 0 {
+		s.windowSize = 1
+	}
+	blockLen := len(s.send) - 4
+	for {
+		// Build up to windowSize DATA blocks, per RFC 7440 §3. Each block
+		// is kept around in s.window so sendWindowWithRetry can resend the
+		// whole window if the ACK for it is lost.
+		windowStart := s.block + 1
+		s.window = s.window[:0]
+		eof := false
+		for uint16(len(s.window)) < s.windowSize && !eof {
+			s.block++
+			buf := make([]byte, 4+blockLen)
+			binary.BigEndian.PutUint16(buf[:2], opDATA)
+			l, rerr := io.ReadFull(r, buf[4:])
+			if rerr == io.ErrUnexpectedEOF || rerr == io.EOF {
+				eof = true
+			} else if rerr != nil {
+				return n, rerr
+			}
+			binary.BigEndian.PutUint16(buf[2:4], s.block)
+			n += int64(l)
+			s.window = append(s.window, buf[:4+l])
+		}
+		ack, err := s.sendWindowWithRetry(windowStart, s.block)
+		if err != nil {
+			s.abort(err)
+			return n, err
+		}
+		if ack == s.block {
+			if eof {
+				return n, nil
+			}
+			continue
+		}
+		// RFC 7440 §4 "sorcerer's apprentice" avoidance: the ACK only
+		// covers blocks up to ack. Rewind the file position and block
+		// counter and resend the remainder of the window starting at
+		// ack+1. Sum each unacked block's actual payload length rather
+		// than assuming blockLen: the window may include the file's
+		// final, short block. A reader that is not an io.Seeker cannot be
+		// rewound, so the transfer fails with an error instead.
+		var lost int64
+		for _, pkt := range s.window[ack-windowStart+1:] {
+			lost += int64(len(pkt) - 4)
+		}
+		seeker, ok := r.(io.Seeker)
+		if !ok {
+			return n, fmt.Errorf("cannot resend blocks after %d: reader is not an io.Seeker", ack)
+		}
+		if _, serr := seeker.Seek(-lost, io.SeekCurrent); serr != nil {
+			return n, serr
+		}
+		n -= lost
+		s.block = ack
+	}
+}
+
+func (s *sender) sendOptions() error {
+	for name, value := range s.opts {
+		switch name {
+		case "blksize":
+			err := s.setBlockSize(value)
+			if err != nil {
+				delete(s.opts, name)
+				continue
+			}
+		case "windowsize":
+			err := s.setWindowSize(value)
+			if err != nil {
+				delete(s.opts, name)
+				continue
+			}
+		case "tsize":
+			// The client sends tsize=0 on a RRQ to ask us to report the
+			// size; we can only answer if the read handler told us via
+			// SetSize before the OACK goes out.
+			if !s.sizeKnown {
+				delete(s.opts, name)
+				continue
+			}
+			s.opts[name] = strconv.FormatInt(s.size, 10)
+		case "timeout":
+			err := s.setTimeout(value)
+			if err != nil {
+				delete(s.opts, name)
+				continue
+			}
+		default:
+			delete(s.opts, name)
+		}
+	}
+	if len(s.opts) > 0 {
+		m := packOACK(s.receive, s.opts)
+		oack := make([]byte, m)
+		copy(oack, s.receive[:m])
+		s.window = [][]byte{oack}
+		if _, err := s.sendWindowWithRetry(0, 0); err != nil {
+			s.abort(err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sender) setBlockSize(blksize string) error {
+	n, err := strconv.Atoi(blksize)
+	if err != nil {
+		return err
+	}
+	if n < defaultBlockSize {
+		return fmt.Errorf("blksize too small: %d", n)
+	}
+	if n > maxBlockSize {
+		return fmt.Errorf("blksize tool large: %d", n)
+	}
+	s.send = make([]byte, n+4)
+	return nil
+}
+
+func (s *sender) setWindowSize(windowsize string) error {
+	n, err := strconv.Atoi(windowsize)
+	if err != nil {
+		return err
+	}
+	if n < 1 || n > 65535 {
+		return fmt.Errorf("windowsize out of range: %d", n)
+	}
+	// maxWindow == 0 means the operator never opted into windowing at
+	// all, so the negotiated size must not exceed the classic default.
+	max := int(s.maxWindow)
+	if max == 0 {
+		max = 1
+	}
+	if n > max {
+		return fmt.Errorf("windowsize too large: %d", n)
+	}
+	s.windowSize = uint16(n)
+	return nil
+}
+
+func (s *sender) setTimeout(timeout string) error {
+	n, err := strconv.Atoi(timeout)
+	if err != nil {
+		return err
+	}
+	if n < 1 || n > 255 {
+		return fmt.Errorf("timeout out of range: %d", n)
+	}
+	s.timeout = time.Duration(n) * time.Second
+	return nil
+}
+
+// sendWindowWithRetry transmits s.window and waits for an ACK covering
+// one of its blocks, retrying on transient errors. On every retry it
+// retransmits the whole window again, since a timeout means either the
+// window or the ACK for it was lost in flight. ACKs outside [windowStart,
+// windowEnd] (late duplicates of an already-acknowledged block) are
+// discarded and do not count against the retry budget.
+func (s *sender) sendWindowWithRetry(windowStart, windowEnd uint16) (uint16, error) {
+	s.retry.reset()
+	for {
+		for _, pkt := range s.window {
+			if _, err := s.conn.WriteToUDP(pkt, s.addr); err != nil {
+				return 0, err
+			}
+		}
+		ack, err := s.receiveDatagram(windowStart, windowEnd)
+		if _, ok := err.(net.Error); ok && s.retry.count() < s.retries {
+			s.retry.backoff()
+			continue
+		}
+		return ack, err
+	}
+}
+
+// readFromUDP reads the next datagram addressed to this transfer. In
+// classic mode it reads s.conn directly; in single-port mode s.conn is
+// shared across transfers, so it instead waits on the per-transfer
+// channel that Server.handlePacket demultiplexes incoming datagrams
+// into, timing out the same way a real socket read would.
+func (s *sender) readFromUDP() (int, *net.UDPAddr, error) {
+	if s.in == nil {
+		return s.conn.ReadFromUDP(s.receive)
+	}
+	select {
+	case pkt, ok := <-s.in:
+		if !ok {
+			return 0, nil, fmt.Errorf("transfer channel closed")
+		}
+		return copy(s.receive, pkt.buf), pkt.addr, nil
+	case <-time.After(s.timeout):
+		return 0, nil, chanReadTimeout{}
+	}
+}
+
+func (s *sender) receiveDatagram(windowStart, windowEnd uint16) (uint16, error) {
+	if s.in == nil {
+		if err := s.conn.SetReadDeadline(time.Now().Add(s.timeout)); err != nil {
+			return 0, err
+		}
+	}
+	for {
+		c, addr, err := s.readFromUDP()
+		if err != nil {
+			return 0, err
+		}
+		if !addr.IP.Equal(s.addr.IP) || (s.tid != 0 && addr.Port != s.tid) {
+			continue
+		}
+		p, err := parsePacket(s.receive[:c])
+		if err != nil {
+			return 0, err
+		}
+		s.tid = addr.Port
+		switch p := p.(type) {
+		case pACK:
+			block := p.block()
+			if block-windowStart > windowEnd-windowStart {
+				// Not a block we sent in this window; ignore it.
+				continue
+			}
+			return block, nil
+		case pERROR:
+			return 0, fmt.Errorf("code: %d, message: %s",
+				p.code(), p.message())
+		}
+	}
+}
+
+func (s *sender) abort(err error) error {
+	if s.conn == nil {
+		return nil
+	}
+	defer func() {
+		if s.ownsConn {
+			s.conn.Close()
+		}
+		s.conn = nil
+	}()
+	n := packERROR(s.receive, 1, err.Error())
+	_, err = s.conn.WriteToUDP(s.receive[:n], s.addr)
+	return err
+}
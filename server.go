@@ -1,272 +1,503 @@
-package sftp
-
-import (
-	"fmt"
-	"io"
-	"net"
-	"sync"
-	"time"
-
-	"golang.org/x/net/ipv4"
-	"golang.org/x/net/ipv6"
-)
-
-// NewServer creates SFTP server. It requires two functions to handle
-// read and write requests.
-// In case nil is provided for read or write handler the respective
-// operation is disabled.
-func NewServer(readHandler func(filename string, rf io.ReaderFrom) error,
-	writeHandler func(filename string, wt io.WriterTo) error) *Server {
-	return &Server{
-		readHandler:  readHandler,
-		writeHandler: writeHandler,
-		timeout:      defaultTimeout,
-		retries:      defaultRetries,
-	}
-}
-
-type Server struct {
-	readHandler  func(filename string, rf io.ReaderFrom) error
-	writeHandler func(filename string, wt io.WriterTo) error
-	backoff      backoffFunc
-	conn         *net.UDPConn
-	quit         chan chan struct{}
-	wg           sync.WaitGroup
-	timeout      time.Duration
-	retries      int
-}
-
-// SetTimeout sets maximum time server waits for single network
-// round-trip to succeed.
-// Default is 5 seconds.
-func (s *Server) SetTimeout(t time.Duration) {
-	if t <= 0 {
-		s.timeout = defaultTimeout
-	} else {
-		s.timeout = t
-	}
-}
-
-// SetRetries sets maximum number of attempts server made to transmit a
-// packet.
-// Default is 5 attempts.
-func (s *Server) SetRetries(count int) {
-	if count < 1 {
-		s.retries = defaultRetries
-	} else {
-		s.retries = count
-	}
-}
-
-// SetBackoff sets a user provided function that is called to provide a
-// backoff duration prior to retransmitting an unacknowledged packet.
-func (s *Server) SetBackoff(h backoffFunc) {
-	s.backoff = h
-}
-
-// ListenAndServe binds to address provided and start the server.
-// ListenAndServe returns when Shutdown is called.
-func (s *Server) ListenAndServe(addr string) error {
-	a, err := net.ResolveUDPAddr("udp", addr)
-	if err != nil {
-		return err
-	}
-	conn, err := net.ListenUDP("udp", a)
-	if err != nil {
-		return err
-	}
-	return s.Serve(conn)
-}
-
-// Serve starts server provided already opened UDP connecton. It is
-// useful for the case when you want to run server in separate goroutine
-// but still want to be able to handle any errors opening connection.
-// Serve returns when Shutdown is called or connection is closed.
-func (s *Server) Serve(conn *net.UDPConn) error {
-	defer conn.Close()
-	laddr := conn.LocalAddr()
-	host, _, err := net.SplitHostPort(laddr.String())
-	if err != nil {
-		return err
-	}
-	s.conn = conn
-	// Having seperate control paths for IP4 and IP6 is annoying,
-	// but necessary at this point
-	addr := net.ParseIP(host)
-	if addr == nil {
-		return fmt.Errorf("Failed to determine IP class of listening address")
-	}
-	var conn4 *ipv4.PacketConn
-	var conn6 *ipv6.PacketConn
-	if addr.To4() != nil {
-		conn4 = ipv4.NewPacketConn(conn)
-		if err := conn4.SetControlMessage(ipv4.FlagDst, true); err != nil {
-			conn4 = nil
-		}
-	} else {
-		conn6 = ipv6.NewPacketConn(conn)
-		if err := conn6.SetControlMessage(ipv6.FlagDst, true); err != nil {
-			conn6 = nil
-		}
-	}
-	s.quit = make(chan chan struct{})
-	for {
-		select {
-		case q := <-s.quit:
-			q <- struct{}{}
-			return nil
-		default:
-			var err error
-			if conn4 != nil {
-				err = s.processRequest4(conn4)
-			} else if conn6 != nil {
-				err = s.processRequest6(conn6)
-			} else {
-				err = s.processRequest()
-			}
-			if err != nil {
-				// TODO: add logging handler
-			}
-		}
-	}
-}
-
-// Yes, I don't really like having seperate IPv4 and IPv6 variants,
-// but we are relying on the low-level packet control channel info to
-// get a reliable source address, and those have different types and
-// the struct itself is not easily interface-ized or embedded.
-//
-// If control is nil for whatever reason (either things not being
-// implemented on a target OS or whatever other reason), localIP
-// (and hence LocalIP()) will return a nil IP address.
-func (s *Server) processRequest4(conn4 *ipv4.PacketConn) error {
-	buf := make([]byte, datagramLength)
-	cnt, control, srcAddr, err := conn4.ReadFrom(buf)
-	if err != nil {
-		return fmt.Errorf("reading UDP: %v", err)
-	}
-	var localAddr net.IP
-	if control != nil {
-		localAddr = control.Dst
-	}
-	return s.handlePacket(localAddr, srcAddr.(*net.UDPAddr), buf, cnt)
-}
-
-func (s *Server) processRequest6(conn6 *ipv6.PacketConn) error {
-	buf := make([]byte, datagramLength)
-	cnt, control, srcAddr, err := conn6.ReadFrom(buf)
-	if err != nil {
-		return fmt.Errorf("reading UDP: %v", err)
-	}
-	var localAddr net.IP
-	if control != nil {
-		localAddr = control.Dst
-	}
-	return s.handlePacket(localAddr, srcAddr.(*net.UDPAddr), buf, cnt)
-}
-
-// Fallback if we had problems opening a ipv4/6 control channel
-func (s *Server) processRequest() error {
-	buf := make([]byte, datagramLength)
-	cnt, srcAddr, err := s.conn.ReadFromUDP(buf)
-	if err != nil {
-		return fmt.Errorf("reading UDP: %v", err)
-	}
-	return s.handlePacket(nil, srcAddr, buf, cnt)
-}
-
-// Shutdown make server stop listening for new requests, allows
-// server to finish outstanding transfers and stops server.
-func (s *Server) Shutdown() {
-	s.conn.Close()
-	q := make(chan struct{})
-	s.quit <- q
-	<-q
-	s.wg.Wait()
-}
-
-func (s *Server) handlePacket(localAddr net.IP, remoteAddr *net.UDPAddr, buffer []byte, n int) error {
-	p, err := parsePacket(buffer[:n])
-	if err != nil {
-		return err
-	}
-	switch p := p.(type) {
-	case pWRQ:
-		filename, mode, opts, err := unpackRQ(p)
-		if err != nil {
-			return fmt.Errorf("unpack WRQ: %v", err)
-		}
-		//fmt.Printf("got WRQ (filename=%s, mode=%s, opts=%v)\n", filename, mode, opts)
-		conn, err := net.ListenUDP("udp", &net.UDPAddr{})
-		if err != nil {
-			return err
-		}
-		if err != nil {
-			return fmt.Errorf("open transmission: %v", err)
-		}
-		wt := &receiver{
-			send:    make([]byte, datagramLength),
-			receive: make([]byte, datagramLength),
-			conn:    conn,
-			retry:   &backoff{handler: s.backoff},
-			timeout: s.timeout,
-			retries: s.retries,
-			addr:    remoteAddr,
-			localIP: localAddr,
-			mode:    mode,
-			opts:    opts,
-		}
-		s.wg.Add(1)
-		go func() {
-			if s.writeHandler != nil {
-				err := s.writeHandler(filename, wt)
-				if err != nil {
-					wt.abort(err)
-				} else {
-					wt.terminate()
-				}
-			} else {
-				wt.abort(fmt.Errorf("server does not support write requests"))
-			}
-			s.wg.Done()
-		}()
-	case pRRQ:
-		filename, mode, opts, err := unpackRQ(p)
-		if err != nil {
-			return fmt.Errorf("unpack RRQ: %v", err)
-		}
-		//fmt.Printf("got RRQ (filename=%s, mode=%s, opts=%v)\n", filename, mode, opts)
-		conn, err := net.ListenUDP("udp", &net.UDPAddr{})
-		if err != nil {
-			return err
-		}
-		rf := &sender{
-			send:    make([]byte, datagramLength),
-			receive: make([]byte, datagramLength),
-			tid:     remoteAddr.Port,
-			conn:    conn,
-			retry:   &backoff{handler: s.backoff},
-			timeout: s.timeout,
-			retries: s.retries,
-			addr:    remoteAddr,
-			localIP: localAddr,
-			mode:    mode,
-			opts:    opts,
-		}
-		s.wg.Add(1)
-		go func() {
-			if s.readHandler != nil {
-				err := s.readHandler(filename, rf)
-				if err != nil {
-					rf.abort(err)
-				}
-			} else {
-				rf.abort(fmt.Errorf("server does not support read requests"))
-			}
-			s.wg.Done()
-		}()
-	default:
-		return fmt.Errorf("unexpected %T", p)
-	}
-	return nil
-}
+package sftp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Request describes an incoming RRQ or WRQ, passed to the handlers
+// registered with NewServerContext.
+type Request struct {
+	Filename   string
+	Mode       string
+	RemoteAddr *net.UDPAddr
+	LocalIP    net.IP
+	Options    map[string]string
+	// Context is cancelled when the transfer is aborted or the server is
+	// shut down. A handler that blocks on I/O can select on Done() to
+	// unwind early instead of leaking past the transfer's lifetime.
+	Context context.Context
+}
+
+// NewServer creates SFTP server. It requires two functions to handle
+// read and write requests.
+// In case nil is provided for read or write handler the respective
+// operation is disabled.
+//
+// NewServer is a thin shim over NewServerContext for handlers that don't
+// need the requesting peer's address or a cancellation context.
+func NewServer(readHandler func(filename string, rf io.ReaderFrom) error,
+	writeHandler func(filename string, wt io.WriterTo) error) *Server {
+	var rh func(*Request, io.ReaderFrom) error
+	if readHandler != nil {
+		rh = func(req *Request, rf io.ReaderFrom) error {
+			return readHandler(req.Filename, rf)
+		}
+	}
+	var wh func(*Request, io.WriterTo) error
+	if writeHandler != nil {
+		wh = func(req *Request, wt io.WriterTo) error {
+			return writeHandler(req.Filename, wt)
+		}
+	}
+	return NewServerContext(rh, wh)
+}
+
+// NewServerContext creates a SFTP server whose handlers receive a
+// *Request describing the peer and the options its request carried
+// (ReadFrom/WriteTo later turns that same map into the options sent in
+// the OACK), and a
+// Context tied to the transfer's lifetime, in addition to the same
+// io.ReaderFrom/io.WriterTo NewServer's handlers get.
+// In case nil is provided for read or write handler the respective
+// operation is disabled.
+func NewServerContext(readHandler func(req *Request, rf io.ReaderFrom) error,
+	writeHandler func(req *Request, wt io.WriterTo) error) *Server {
+	return &Server{
+		readHandler:  readHandler,
+		writeHandler: writeHandler,
+		timeout:      defaultTimeout,
+		retries:      defaultRetries,
+	}
+}
+
+type Server struct {
+	readHandler  func(req *Request, rf io.ReaderFrom) error
+	writeHandler func(req *Request, wt io.WriterTo) error
+	hook         func(*Request) error
+	backoff      backoffFunc
+	conn         *net.UDPConn
+	quit         chan chan struct{}
+	wg           sync.WaitGroup
+	timeout      time.Duration
+	retries      int
+	windowSize   uint16
+	singlePort   bool
+	transfersMu  sync.Mutex
+	transfers    map[string]chan incomingPacket
+	ctx          context.Context
+	cancel       context.CancelFunc
+}
+
+// incomingPacket carries one datagram and its source address from the
+// shared Serve read loop to the per-transfer goroutine handling it, when
+// the server is running in single-port mode.
+type incomingPacket struct {
+	buf  []byte
+	addr *net.UDPAddr
+}
+
+// chanReadTimeout satisfies net.Error so that reading from a
+// single-port transfer's packet channel times out the same way a real
+// socket read does, and the existing retry logic in receiver/sender
+// treats the two identically.
+type chanReadTimeout struct{}
+
+func (chanReadTimeout) Error() string   { return "tftp: single-port read timeout" }
+func (chanReadTimeout) Timeout() bool   { return true }
+func (chanReadTimeout) Temporary() bool { return true }
+
+// defaultWindowSize is the RFC 7440 window size used when a client does
+// not negotiate windowsize, or when SetWindowSize has not been called:
+// one DATA block per ACK, matching classic TFTP lock-step behavior.
+const defaultWindowSize = 1
+
+// SetTimeout sets maximum time server waits for single network
+// round-trip to succeed.
+// Default is 5 seconds.
+func (s *Server) SetTimeout(t time.Duration) {
+	if t <= 0 {
+		s.timeout = defaultTimeout
+	} else {
+		s.timeout = t
+	}
+}
+
+// SetRetries sets maximum number of attempts server made to transmit a
+// packet.
+// Default is 5 attempts.
+func (s *Server) SetRetries(count int) {
+	if count < 1 {
+		s.retries = defaultRetries
+	} else {
+		s.retries = count
+	}
+}
+
+// SetBackoff sets a user provided function that is called to provide a
+// backoff duration prior to retransmitting an unacknowledged packet.
+func (s *Server) SetBackoff(h backoffFunc) {
+	s.backoff = h
+}
+
+// SetWindowSize sets the RFC 7440 window size the server will offer to
+// negotiate: the number of DATA blocks a transfer may send before
+// requiring an ACK. Valid range is 1..65535.
+// Default is 1, which matches the original TFTP lock-step behavior.
+// Clients that don't understand the windowsize option simply don't
+// negotiate it, and the transfer falls back to windowsize=1.
+func (s *Server) SetWindowSize(n int) {
+	if n < 1 || n > 65535 {
+		s.windowSize = defaultWindowSize
+	} else {
+		s.windowSize = uint16(n)
+	}
+}
+
+// SetSinglePort switches the server between classic mode, where every
+// transfer opens a fresh ephemeral UDP socket (a new TID), and
+// single-port mode, where every transfer shares the listening socket
+// and Serve demultiplexes datagrams by remote address into a
+// per-transfer channel instead. Single-port mode lets the server run
+// behind a firewall/NAT that only forwards the one well-known port.
+// Default is false (classic mode).
+func (s *Server) SetSinglePort(b bool) {
+	s.singlePort = b
+}
+
+func (s *Server) lookupTransfer(addr *net.UDPAddr) (chan incomingPacket, bool) {
+	s.transfersMu.Lock()
+	defer s.transfersMu.Unlock()
+	ch, ok := s.transfers[addr.String()]
+	return ch, ok
+}
+
+func (s *Server) registerTransfer(addr *net.UDPAddr) chan incomingPacket {
+	ch := make(chan incomingPacket, 8)
+	s.transfersMu.Lock()
+	s.transfers[addr.String()] = ch
+	s.transfersMu.Unlock()
+	return ch
+}
+
+// SetHook sets a function that is invoked with the parsed *Request
+// before a RRQ or WRQ is dispatched to a handler. Returning an error
+// from the hook rejects the request with a TFTP ERROR packet instead of
+// calling the read/write handler at all, so an IP allowlist, rate
+// limiter, or path traversal check can live in one place rather than in
+// every handler.
+func (s *Server) SetHook(h func(*Request) error) {
+	s.hook = h
+}
+
+func (s *Server) unregisterTransfer(addr *net.UDPAddr) {
+	s.transfersMu.Lock()
+	delete(s.transfers, addr.String())
+	s.transfersMu.Unlock()
+}
+
+// ListenAndServe binds to address provided and start the server.
+// ListenAndServe returns when Shutdown is called.
+func (s *Server) ListenAndServe(addr string) error {
+	a, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", a)
+	if err != nil {
+		return err
+	}
+	return s.Serve(conn)
+}
+
+// Serve starts server provided already opened UDP connecton. It is
+// useful for the case when you want to run server in separate goroutine
+// but still want to be able to handle any errors opening connection.
+// Serve returns when Shutdown is called or connection is closed.
+func (s *Server) Serve(conn *net.UDPConn) error {
+	defer conn.Close()
+	laddr := conn.LocalAddr()
+	host, _, err := net.SplitHostPort(laddr.String())
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	// Having seperate control paths for IP4 and IP6 is annoying,
+	// but necessary at this point
+	addr := net.ParseIP(host)
+	if addr == nil {
+		return fmt.Errorf("Failed to determine IP class of listening address")
+	}
+	var conn4 *ipv4.PacketConn
+	var conn6 *ipv6.PacketConn
+	if addr.To4() != nil {
+		conn4 = ipv4.NewPacketConn(conn)
+		if err := conn4.SetControlMessage(ipv4.FlagDst, true); err != nil {
+			conn4 = nil
+		}
+	} else {
+		conn6 = ipv6.NewPacketConn(conn)
+		if err := conn6.SetControlMessage(ipv6.FlagDst, true); err != nil {
+			conn6 = nil
+		}
+	}
+	s.quit = make(chan chan struct{})
+	s.transfers = make(map[string]chan incomingPacket)
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	for {
+		select {
+		case q := <-s.quit:
+			q <- struct{}{}
+			return nil
+		default:
+			var err error
+			if conn4 != nil {
+				err = s.processRequest4(conn4)
+			} else if conn6 != nil {
+				err = s.processRequest6(conn6)
+			} else {
+				err = s.processRequest()
+			}
+			if err != nil {
+				// TODO: add logging handler
+			}
+		}
+	}
+}
+
+// Yes, I don't really like having seperate IPv4 and IPv6 variants,
+// but we are relying on the low-level packet control channel info to
+// get a reliable source address, and those have different types and
+// the struct itself is not easily interface-ized or embedded.
+//
+// If control is nil for whatever reason (either things not being
+// implemented on a target OS or whatever other reason), localIP
+// (and hence LocalIP()) will return a nil IP address.
+func (s *Server) processRequest4(conn4 *ipv4.PacketConn) error {
+	buf := make([]byte, datagramLength)
+	cnt, control, srcAddr, err := conn4.ReadFrom(buf)
+	if err != nil {
+		return fmt.Errorf("reading UDP: %v", err)
+	}
+	var localAddr net.IP
+	if control != nil {
+		localAddr = control.Dst
+	}
+	return s.handlePacket(localAddr, srcAddr.(*net.UDPAddr), buf, cnt)
+}
+
+func (s *Server) processRequest6(conn6 *ipv6.PacketConn) error {
+	buf := make([]byte, datagramLength)
+	cnt, control, srcAddr, err := conn6.ReadFrom(buf)
+	if err != nil {
+		return fmt.Errorf("reading UDP: %v", err)
+	}
+	var localAddr net.IP
+	if control != nil {
+		localAddr = control.Dst
+	}
+	return s.handlePacket(localAddr, srcAddr.(*net.UDPAddr), buf, cnt)
+}
+
+// Fallback if we had problems opening a ipv4/6 control channel
+func (s *Server) processRequest() error {
+	buf := make([]byte, datagramLength)
+	cnt, srcAddr, err := s.conn.ReadFromUDP(buf)
+	if err != nil {
+		return fmt.Errorf("reading UDP: %v", err)
+	}
+	return s.handlePacket(nil, srcAddr, buf, cnt)
+}
+
+// Shutdown make server stop listening for new requests, allows
+// server to finish outstanding transfers and stops server.
+func (s *Server) Shutdown() {
+	s.conn.Close()
+	q := make(chan struct{})
+	s.quit <- q
+	<-q
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.wg.Wait()
+}
+
+// sendError rejects a request with a TFTP ERROR packet, without
+// allocating any transfer state. Used when SetHook's callback declines
+// a request before a handler is ever invoked.
+func (s *Server) sendError(addr *net.UDPAddr, err error) error {
+	buf := make([]byte, datagramLength)
+	n := packERROR(buf, 1, err.Error())
+	if s.singlePort {
+		_, werr := s.conn.WriteToUDP(buf[:n], addr)
+		return werr
+	}
+	conn, cerr := net.ListenUDP("udp", &net.UDPAddr{})
+	if cerr != nil {
+		return cerr
+	}
+	defer conn.Close()
+	_, werr := conn.WriteToUDP(buf[:n], addr)
+	return werr
+}
+
+func (s *Server) handlePacket(localAddr net.IP, remoteAddr *net.UDPAddr, buffer []byte, n int) error {
+	if s.singlePort {
+		// A transfer already bound to this peer owns the datagram; hand
+		// it off and let the shared read loop move on to the next packet.
+		if ch, ok := s.lookupTransfer(remoteAddr); ok {
+			buf := make([]byte, n)
+			copy(buf, buffer[:n])
+			select {
+			case ch <- incomingPacket{buf: buf, addr: remoteAddr}:
+			default:
+				// Transfer's goroutine isn't keeping up; drop rather than
+				// block the shared socket's read loop.
+			}
+			return nil
+		}
+	}
+	p, err := parsePacket(buffer[:n])
+	if err != nil {
+		return err
+	}
+	switch p := p.(type) {
+	case pWRQ:
+		filename, mode, opts, err := unpackRQ(p)
+		if err != nil {
+			return fmt.Errorf("unpack WRQ: %v", err)
+		}
+		//fmt.Printf("got WRQ (filename=%s, mode=%s, opts=%v)\n", filename, mode, opts)
+		ctx, cancel := context.WithCancel(s.ctx)
+		req := &Request{
+			Filename:   filename,
+			Mode:       mode,
+			RemoteAddr: remoteAddr,
+			LocalIP:    localAddr,
+			Options:    map[string]string(opts),
+			Context:    ctx,
+		}
+		if s.hook != nil {
+			if err := s.hook(req); err != nil {
+				cancel()
+				return s.sendError(remoteAddr, err)
+			}
+		}
+		conn := s.conn
+		var in chan incomingPacket
+		if s.singlePort {
+			in = s.registerTransfer(remoteAddr)
+		} else {
+			conn, err = net.ListenUDP("udp", &net.UDPAddr{})
+			if err != nil {
+				cancel()
+				return err
+			}
+		}
+		wt := &receiver{
+			send:      make([]byte, datagramLength),
+			receive:   make([]byte, datagramLength),
+			conn:      conn,
+			ownsConn:  !s.singlePort,
+			in:        in,
+			retry:     &backoff{handler: s.backoff},
+			timeout:   s.timeout,
+			retries:   s.retries,
+			addr:      remoteAddr,
+			localIP:   localAddr,
+			mode:      mode,
+			opts:      opts,
+			maxWindow: s.windowSize,
+		}
+		// Parse tsize now, before the write handler runs, so it can reject
+		// an over-quota transfer via wt.(interface{ Size() (int64, bool) })
+		// without having to receive any data first.
+		if v, ok := opts["tsize"]; ok {
+			if err := wt.setTsize(v); err != nil {
+				delete(opts, "tsize")
+			}
+		}
+		s.wg.Add(1)
+		go func() {
+			defer cancel()
+			if s.singlePort {
+				defer s.unregisterTransfer(remoteAddr)
+			}
+			if s.writeHandler != nil {
+				err := s.writeHandler(req, wt)
+				if err != nil {
+					wt.abort(err)
+				} else {
+					wt.terminate()
+				}
+			} else {
+				wt.abort(fmt.Errorf("server does not support write requests"))
+			}
+			s.wg.Done()
+		}()
+	case pRRQ:
+		filename, mode, opts, err := unpackRQ(p)
+		if err != nil {
+			return fmt.Errorf("unpack RRQ: %v", err)
+		}
+		//fmt.Printf("got RRQ (filename=%s, mode=%s, opts=%v)\n", filename, mode, opts)
+		ctx, cancel := context.WithCancel(s.ctx)
+		req := &Request{
+			Filename:   filename,
+			Mode:       mode,
+			RemoteAddr: remoteAddr,
+			LocalIP:    localAddr,
+			Options:    map[string]string(opts),
+			Context:    ctx,
+		}
+		if s.hook != nil {
+			if err := s.hook(req); err != nil {
+				cancel()
+				return s.sendError(remoteAddr, err)
+			}
+		}
+		conn := s.conn
+		var in chan incomingPacket
+		if s.singlePort {
+			in = s.registerTransfer(remoteAddr)
+		} else {
+			conn, err = net.ListenUDP("udp", &net.UDPAddr{})
+			if err != nil {
+				cancel()
+				return err
+			}
+		}
+		rf := &sender{
+			send:      make([]byte, datagramLength),
+			receive:   make([]byte, datagramLength),
+			tid:       remoteAddr.Port,
+			conn:      conn,
+			ownsConn:  !s.singlePort,
+			in:        in,
+			retry:     &backoff{handler: s.backoff},
+			timeout:   s.timeout,
+			retries:   s.retries,
+			addr:      remoteAddr,
+			localIP:   localAddr,
+			mode:      mode,
+			opts:      opts,
+			maxWindow: s.windowSize,
+		}
+		s.wg.Add(1)
+		go func() {
+			defer cancel()
+			if s.singlePort {
+				defer s.unregisterTransfer(remoteAddr)
+			}
+			if s.readHandler != nil {
+				err := s.readHandler(req, rf)
+				if err != nil {
+					rf.abort(err)
+				}
+			} else {
+				rf.abort(fmt.Errorf("server does not support read requests"))
+			}
+			s.wg.Done()
+		}()
+	default:
+		return fmt.Errorf("unexpected %T", p)
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+package sftp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memStore is a trivial in-memory file store backing the read/write
+// handlers used by the round-trip tests below.
+type memStore struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func newMemStore() *memStore {
+	return &memStore{files: make(map[string][]byte)}
+}
+
+func (m *memStore) read(filename string, rf io.ReaderFrom) error {
+	m.mu.Lock()
+	data, ok := m.files[filename]
+	m.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("not found: %s", filename)
+	}
+	_, err := rf.ReadFrom(bytes.NewReader(data))
+	return err
+}
+
+func (m *memStore) write(filename string, wt io.WriterTo) error {
+	var buf bytes.Buffer
+	if _, err := wt.WriteTo(&buf); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.files[filename] = append([]byte(nil), buf.Bytes()...)
+	m.mu.Unlock()
+	return nil
+}
+
+// startTestServer starts a Server bound to a loopback address and
+// returns it along with that address. The server is shut down via
+// t.Cleanup.
+func startTestServer(t *testing.T, store *memStore, singlePort bool, windowSize int) *net.UDPAddr {
+	t.Helper()
+	srv := NewServer(store.read, store.write)
+	srv.SetSinglePort(singlePort)
+	srv.SetTimeout(200 * time.Millisecond)
+	if windowSize > 1 {
+		srv.SetWindowSize(windowSize)
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	go srv.Serve(conn)
+	t.Cleanup(srv.Shutdown)
+	return addr
+}
+
+// roundTrip sends data to the server under filename via cl.Send, then
+// reads it back via cl.Receive and returns what came back.
+func roundTrip(t *testing.T, cl *Client, filename string, data []byte) []byte {
+	t.Helper()
+	wt, err := cl.Send(filename, "octet")
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if _, err := wt.ReadFrom(bytes.NewReader(data)); err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+	rf, err := cl.Receive(filename, "octet")
+	if err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+	var got bytes.Buffer
+	if _, err := rf.WriteTo(&got); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	return got.Bytes()
+}
+
+func TestClientServerRoundTrip(t *testing.T) {
+	for _, singlePort := range []bool{false, true} {
+		name := "classic"
+		if singlePort {
+			name = "single-port"
+		}
+		t.Run(name, func(t *testing.T) {
+			addr := startTestServer(t, newMemStore(), singlePort, 0)
+			cl, err := NewClient(addr.String())
+			if err != nil {
+				t.Fatalf("NewClient: %v", err)
+			}
+			cl.SetTimeout(200 * time.Millisecond)
+
+			want := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), 50)
+			got := roundTrip(t, cl, "greeting.txt", want)
+			if !bytes.Equal(got, want) {
+				t.Fatalf("round trip mismatch: got %d bytes, want %d", len(got), len(want))
+			}
+		})
+	}
+}
+
+// lossyRelay sits between a Client and the real Server, forwarding
+// datagrams in both directions while dropping every dropEvery-th one, to
+// exercise window retransmission on packet loss. It assumes a single
+// transfer in flight at a time, which is all these tests need.
+type lossyRelay struct {
+	front *net.UDPConn
+	back  *net.UDPConn
+
+	mu      sync.Mutex
+	client  *net.UDPAddr
+	backend *net.UDPAddr
+	n       int
+}
+
+func newLossyRelay(t *testing.T, serverAddr *net.UDPAddr, dropEvery int) *net.UDPAddr {
+	t.Helper()
+	front, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("listen relay front: %v", err)
+	}
+	back, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("listen relay back: %v", err)
+	}
+	r := &lossyRelay{front: front, back: back, backend: serverAddr}
+
+	drop := func() bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.n++
+		return dropEvery > 0 && r.n%dropEvery == 0
+	}
+
+	go func() {
+		buf := make([]byte, datagramLength)
+		for {
+			c, raddr, err := front.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			r.mu.Lock()
+			if r.client == nil || r.client.String() != raddr.String() {
+				// A new client socket starts a new transfer, whose request
+				// goes to the server's listening address rather than to the
+				// previous transfer's TID.
+				r.backend = serverAddr
+			}
+			r.client = raddr
+			backend := r.backend
+			r.mu.Unlock()
+			if drop() {
+				continue
+			}
+			back.WriteToUDP(buf[:c], backend)
+		}
+	}()
+	go func() {
+		buf := make([]byte, datagramLength)
+		for {
+			c, raddr, err := back.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			r.mu.Lock()
+			r.backend = raddr
+			client := r.client
+			r.mu.Unlock()
+			if client == nil || drop() {
+				continue
+			}
+			front.WriteToUDP(buf[:c], client)
+		}
+	}()
+
+	t.Cleanup(func() {
+		front.Close()
+		back.Close()
+	})
+	return front.LocalAddr().(*net.UDPAddr)
+}
+
+func TestClientServerRoundTripWindowedWithLoss(t *testing.T) {
+	addr := startTestServer(t, newMemStore(), false, 4)
+	relayAddr := newLossyRelay(t, addr, 7)
+
+	cl, err := NewClient(relayAddr.String())
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	cl.SetTimeout(200 * time.Millisecond)
+	cl.SetWindowSize(4)
+
+	want := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+	got := roundTrip(t, cl, "big.bin", want)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("round trip mismatch: got %d bytes, want %d", len(got), len(want))
+	}
+}
+
+// TestServerNegotiatesTsizeAndTimeout drives a RRQ at the packet level,
+// since Client itself never requests tsize or timeout, to exercise the
+// chunk0-2 option negotiation the higher-level round-trip tests above
+// don't touch.
+func TestServerNegotiatesTsizeAndTimeout(t *testing.T) {
+	want := bytes.Repeat([]byte("tsize and timeout negotiation "), 20)
+
+	srv := NewServer(func(filename string, rf io.ReaderFrom) error {
+		if sizer, ok := rf.(interface{ SetSize(int64) }); ok {
+			sizer.SetSize(int64(len(want)))
+		}
+		_, err := rf.ReadFrom(bytes.NewReader(want))
+		return err
+	}, nil)
+	srv.SetTimeout(100 * time.Millisecond)
+	srv.SetRetries(1)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	go srv.Serve(conn)
+	t.Cleanup(srv.Shutdown)
+
+	cconn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatalf("listen client: %v", err)
+	}
+	defer cconn.Close()
+
+	req := make([]byte, datagramLength)
+	n := packRQ(req, opRRQ, "sized.bin", "octet", options{"tsize": "0", "timeout": "3"})
+	if err := cconn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("SetReadDeadline: %v", err)
+	}
+	if _, err := cconn.WriteToUDP(req[:n], addr); err != nil {
+		t.Fatalf("WriteToUDP: %v", err)
+	}
+
+	buf := make([]byte, datagramLength)
+	rn, _, err := cconn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("read OACK: %v", err)
+	}
+	p, err := parsePacket(buf[:rn])
+	if err != nil {
+		t.Fatalf("parsePacket: %v", err)
+	}
+	oack, ok := p.(pOACK)
+	if !ok {
+		t.Fatalf("expected pOACK, got %T", p)
+	}
+	opts, err := unpackOACK(oack)
+	if err != nil {
+		t.Fatalf("unpackOACK: %v", err)
+	}
+	if got := opts["tsize"]; got != strconv.Itoa(len(want)) {
+		t.Fatalf("tsize = %q, want %d", got, len(want))
+	}
+	if got := opts["timeout"]; got != "3" {
+		t.Fatalf("timeout = %q, want 3", got)
+	}
+}